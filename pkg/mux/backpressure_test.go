@@ -0,0 +1,64 @@
+package mux
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDispatchTimeoutDropsUnacceptedConnection drives a real TCP connection
+// through dispatch() into a matched listener that nobody ever Accept()s
+// from, and checks the connection is dropped once DispatchTimeout elapses -
+// applying backpressure rather than blocking forever or leaking - and that
+// the drop is observable both via OnDrop and via ListenerStats.
+func TestDispatchTimeoutDropsUnacceptedConnection(t *testing.T) {
+	dropped := make(chan error, 1)
+
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{HTTP: true}, MultiplexerOptions{
+		DispatchTimeout:  50 * time.Millisecond,
+		HandshakeTimeout: time.Second,
+		OnDrop: func(conn net.Conn, err error) {
+			select {
+			case dropped <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("ListenWithConfig: %v", err)
+	}
+	defer m.Close()
+
+	addr := m.addr.String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+
+	// Deliberately never call m.HTTP().Accept(): the connection should be
+	// dropped once DispatchTimeout elapses, instead of the dispatch worker
+	// blocking on it forever.
+	select {
+	case err := <-dropped:
+		if err == nil {
+			t.Fatal("expected a non-nil dispatch timeout error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected OnDrop to fire once DispatchTimeout elapsed")
+	}
+
+	// ListenerStats is keyed by the address StartListener was given
+	// ("127.0.0.1:0"), not the OS-assigned address it resolved to.
+	stats, ok := m.ListenerStats("127.0.0.1:0")
+	if !ok {
+		t.Fatal("expected listener stats for 127.0.0.1:0 to exist")
+	}
+	if stats.DroppedCount != 1 {
+		t.Fatalf("DroppedCount = %d, want 1", stats.DroppedCount)
+	}
+}
@@ -0,0 +1,131 @@
+package mux
+
+import (
+	"sync"
+	"time"
+)
+
+// ListenerEventType identifies what happened to a listener in a
+// ListenerEvent.
+type ListenerEventType int
+
+const (
+	// ListenerAdded is emitted once a listener has successfully bound its
+	// address.
+	ListenerAdded ListenerEventType = iota
+	// ListenerRemoved is emitted once a listener has been closed, whether
+	// via StopListener, Close, or its context being cancelled.
+	ListenerRemoved
+	// ListenerErrored is emitted whenever a listener's Accept call returns
+	// an error other than the listener being closed.
+	ListenerErrored
+)
+
+// ListenerEvent describes a change in a listener's lifecycle, delivered to
+// subscribers registered via Subscribe.
+type ListenerEvent struct {
+	Type    ListenerEventType
+	Address string
+	Err     error
+}
+
+// ListenerStats is a point-in-time snapshot of a listener's accept
+// counters, returned by Multiplexer.ListenerStats.
+type ListenerStats struct {
+	AcceptedCount int64
+	DroppedCount  int64
+	LastError     error
+	StartedAt     time.Time
+}
+
+// listenerStats is the mutable, lockable form of ListenerStats kept per
+// address. The entry outlives its listener: it stays in place after the
+// listener is removed or errors, until a new listener is started on the
+// same address.
+type listenerStats struct {
+	mu            sync.Mutex
+	acceptedCount int64
+	droppedCount  int64
+	lastError     error
+	startedAt     time.Time
+}
+
+func (s *listenerStats) recordAccept() {
+	s.mu.Lock()
+	s.acceptedCount++
+	s.mu.Unlock()
+}
+
+func (s *listenerStats) recordError(err error) {
+	s.mu.Lock()
+	s.lastError = err
+	s.mu.Unlock()
+}
+
+func (s *listenerStats) snapshot() ListenerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return ListenerStats{
+		AcceptedCount: s.acceptedCount,
+		DroppedCount:  s.droppedCount,
+		LastError:     s.lastError,
+		StartedAt:     s.startedAt,
+	}
+}
+
+// ListenerStats returns the accept/drop counters for the listener most
+// recently started on address, and whether one was ever started there. It
+// keeps reporting a listener's stats after that listener has been removed.
+func (m *Multiplexer) ListenerStats(address string) (ListenerStats, bool) {
+	m.RLock()
+	stats, ok := m.listenerStats[address]
+	m.RUnlock()
+
+	if !ok {
+		return ListenerStats{}, false
+	}
+
+	return stats.snapshot(), true
+}
+
+// Subscribe registers for ListenerEvents emitted as listeners are added,
+// removed, or error. The returned function unsubscribes and closes the
+// channel; callers should always call it once they're done listening.
+func (m *Multiplexer) Subscribe() (<-chan ListenerEvent, func()) {
+	ch := make(chan ListenerEvent, 16)
+
+	m.Lock()
+	if m.subscribers == nil {
+		m.subscribers = map[chan ListenerEvent]struct{}{}
+	}
+	m.subscribers[ch] = struct{}{}
+	m.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			m.Lock()
+			delete(m.subscribers, ch)
+			m.Unlock()
+			close(ch)
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+// emit delivers event to every current subscriber, dropping it for any
+// subscriber whose channel is full rather than blocking the listener that
+// triggered it.
+func (m *Multiplexer) emit(event ListenerEvent) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for ch := range m.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package mux
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitForEvent drains events until one matching wantType/wantAddress shows
+// up, or the timeout elapses.
+func waitForEvent(t *testing.T, events <-chan ListenerEvent, wantType ListenerEventType, wantAddress string) ListenerEvent {
+	t.Helper()
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == wantType && ev.Address == wantAddress {
+				return ev
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for event {Type: %v, Address: %q}", wantType, wantAddress)
+		}
+	}
+}
+
+// TestListenerLifecycleEventsAndStats starts a second listener via
+// StartListenerContext, cancels its context, and checks that a Subscribe
+// consumer sees both ListenerAdded and ListenerRemoved for it, and that
+// ListenerStats is still queryable afterwards - the behaviour the backlog
+// item promised but the original accept-error path deleted out from under.
+func TestListenerLifecycleEventsAndStats(t *testing.T) {
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{HTTP: true}, MultiplexerOptions{
+		DispatchTimeout:  time.Second,
+		HandshakeTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ListenWithConfig: %v", err)
+	}
+	defer m.Close()
+
+	events, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+
+	// A different literal address than the multiplexer's own listener
+	// ("127.0.0.1:0"), since StartListener keys by the address string
+	// requested rather than what it resolves to.
+	const extraAddr = "localhost:0"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := m.StartListenerContext(ctx, "tcp", extraAddr); err != nil {
+		t.Fatalf("StartListenerContext: %v", err)
+	}
+
+	waitForEvent(t, events, ListenerAdded, extraAddr)
+
+	if _, ok := m.ListenerStats(extraAddr); !ok {
+		t.Fatalf("expected listener stats for %s to exist right after ListenerAdded", extraAddr)
+	}
+
+	cancel()
+
+	waitForEvent(t, events, ListenerRemoved, extraAddr)
+
+	stats, ok := m.ListenerStats(extraAddr)
+	if !ok {
+		t.Fatalf("expected listener stats for %s to remain queryable after ListenerRemoved", extraAddr)
+	}
+	if stats.StartedAt.IsZero() {
+		t.Fatal("expected StartedAt to still be populated after removal")
+	}
+}
@@ -0,0 +1,100 @@
+package mux
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// multiplexerListener implements net.Listener. Instead of accepting
+// connections from the network directly, it receives connections that the
+// Multiplexer has already classified and handed off via connections.
+type multiplexerListener struct {
+	name        string
+	addr        net.Addr
+	connections chan *bufferedConn
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newMultiplexerListener(name string, addr net.Addr) *multiplexerListener {
+	return &multiplexerListener{
+		name:        name,
+		addr:        addr,
+		connections: make(chan *bufferedConn),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (l *multiplexerListener) Accept() (net.Conn, error) {
+	select {
+	case c, ok := <-l.connections:
+		if !ok {
+			return nil, errors.New("Listener closed")
+		}
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+func (l *multiplexerListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *multiplexerListener) Addr() net.Addr {
+	return l.addr
+}
+
+// bufferedConn wraps a net.Conn together with the bytes that were already
+// consumed from it while the Multiplexer was sniffing the protocol, so that
+// those bytes are replayed to the first Read before the underlying
+// connection is touched again.
+type bufferedConn struct {
+	conn   net.Conn
+	prefix []byte
+	offset int
+	mu     sync.Mutex
+
+	// proxy holds the real client/destination addresses described by a
+	// PROXY protocol header, or nil if none was present.
+	proxy *proxyInfo
+}
+
+// ConnInfo returns the address of the real client, as described by a PROXY
+// protocol header, for connections accepted behind an L4 load balancer with
+// ProxyProtocol enabled. If no PROXY protocol header was present, it falls
+// back to RemoteAddr.
+func (b *bufferedConn) ConnInfo() net.Addr {
+	if b.proxy != nil && b.proxy.source != nil {
+		return b.proxy.source
+	}
+
+	return b.conn.RemoteAddr()
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.offset < len(b.prefix) {
+		n := copy(p, b.prefix[b.offset:])
+		b.offset += n
+		b.mu.Unlock()
+		return n, nil
+	}
+	b.mu.Unlock()
+
+	return b.conn.Read(p)
+}
+
+func (b *bufferedConn) Write(p []byte) (int, error) { return b.conn.Write(p) }
+func (b *bufferedConn) Close() error                { return b.conn.Close() }
+func (b *bufferedConn) LocalAddr() net.Addr         { return b.conn.LocalAddr() }
+func (b *bufferedConn) RemoteAddr() net.Addr        { return b.conn.RemoteAddr() }
+
+func (b *bufferedConn) SetDeadline(t time.Time) error      { return b.conn.SetDeadline(t) }
+func (b *bufferedConn) SetReadDeadline(t time.Time) error  { return b.conn.SetReadDeadline(t) }
+func (b *bufferedConn) SetWriteDeadline(t time.Time) error { return b.conn.SetWriteDeadline(t) }
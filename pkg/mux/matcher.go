@@ -0,0 +1,185 @@
+package mux
+
+import "bytes"
+
+// Matcher inspects the bytes read so far from a freshly accepted connection
+// and decides whether they identify a protocol. name is the protocol this
+// peek belongs to, consumed is how many bytes of peek the matcher needed to
+// reach its verdict (used to size the next read when more data is
+// required), and ok reports whether the match succeeded.
+type Matcher func(peek []byte) (name string, consumed int, ok bool)
+
+// matcherRegistration pairs a protocol name with the Matcher that
+// recognises it. Registrations are tried in the order they were added via
+// HandleFunc, so more specific matchers should be registered first.
+type matcherRegistration struct {
+	name    string
+	matcher Matcher
+}
+
+var http1Methods = [][]byte{
+	[]byte("GET"), []byte("HEAD"), []byte("POST"),
+	[]byte("PUT"), []byte("DELETE"), []byte("CONNECT"),
+	[]byte("OPTIONS"), []byte("TRACE"), []byte("PATCH"),
+}
+
+// MatchSSH recognises the SSH identification string every SSH server and
+// client sends first, e.g. "SSH-2.0-OpenSSH_8.9".
+func MatchSSH(peek []byte) (string, int, bool) {
+	if len(peek) < 3 {
+		return "", 3, false
+	}
+
+	return "ssh", 3, bytes.HasPrefix(peek, []byte("SSH"))
+}
+
+// MatchHTTP1 recognises a plaintext HTTP/1.x request line by its method.
+func MatchHTTP1(peek []byte) (string, int, bool) {
+	longest := 0
+	for _, method := range http1Methods {
+		if len(method) > longest {
+			longest = len(method)
+		}
+		if bytes.HasPrefix(peek, method) {
+			return "http", len(method), true
+		}
+	}
+
+	return "", longest, false
+}
+
+// http2Preface is the connection preface an HTTP/2 client sends before any
+// frames when using prior-knowledge (h2c) negotiation.
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// MatchHTTP2 recognises the HTTP/2 prior-knowledge preface.
+func MatchHTTP2(peek []byte) (string, int, bool) {
+	if len(peek) < len(http2Preface) {
+		return "", len(http2Preface), false
+	}
+
+	return "http2", len(http2Preface), bytes.Equal(peek[:len(http2Preface)], http2Preface)
+}
+
+// MatchTLS recognises the start of a TLS record carrying a ClientHello:
+// content type 0x16 (handshake) followed by a record version between
+// TLS 1.0 (0x0301) and TLS 1.3 (0x0304).
+func MatchTLS(peek []byte) (string, int, bool) {
+	if len(peek) < 3 {
+		return "", 3, false
+	}
+
+	if peek[0] != 0x16 {
+		return "", 3, false
+	}
+
+	if peek[1] != 0x03 || peek[2] < 0x01 || peek[2] > 0x04 {
+		return "", 3, false
+	}
+
+	return "tls", 3, true
+}
+
+const tlsExtensionServerName = 0
+
+// sniFromClientHello parses a raw TLS record holding a ClientHello and
+// returns the host name the client requested via the server_name (SNI)
+// extension. peek must start at the first byte of the TLS record (content
+// type 0x16). need reports how many bytes of peek are required before a
+// verdict can be reached, so callers can grow their read buffer and retry.
+func sniFromClientHello(peek []byte) (name string, need int, ok bool) {
+	const recordHeaderLen = 5
+	if len(peek) < recordHeaderLen || peek[0] != 0x16 {
+		return "", recordHeaderLen, false
+	}
+
+	recordLen := int(peek[3])<<8 | int(peek[4])
+	total := recordHeaderLen + recordLen
+	if len(peek) < total {
+		return "", total, false
+	}
+
+	hs := peek[recordHeaderLen:total]
+	if len(hs) < 4 || hs[0] != 0x01 { // handshake type: client_hello
+		return "", total, false
+	}
+
+	body := hs[4:]
+	pos := 2 + 32 // client version + random
+	if pos >= len(body) {
+		return "", total, false
+	}
+
+	pos += 1 + int(body[pos]) // session id
+
+	if pos+2 > len(body) {
+		return "", total, false
+	}
+	pos += 2 + (int(body[pos])<<8 | int(body[pos+1])) // cipher suites
+
+	if pos+1 > len(body) {
+		return "", total, false
+	}
+	pos += 1 + int(body[pos]) // compression methods
+
+	if pos+2 > len(body) {
+		return "", total, false
+	}
+	extensionsLen := int(body[pos])<<8 | int(body[pos+1])
+	pos += 2
+
+	if pos+extensionsLen > len(body) {
+		return "", total, false
+	}
+	extensions := body[pos : pos+extensionsLen]
+
+	for len(extensions) >= 4 {
+		extType := int(extensions[0])<<8 | int(extensions[1])
+		extLen := int(extensions[2])<<8 | int(extensions[3])
+		extensions = extensions[4:]
+		if len(extensions) < extLen {
+			break
+		}
+
+		extData := extensions[:extLen]
+		extensions = extensions[extLen:]
+
+		if extType != tlsExtensionServerName || len(extData) < 2 {
+			continue
+		}
+
+		listLen := int(extData[0])<<8 | int(extData[1])
+		list := extData[2:]
+		if len(list) > listLen {
+			list = list[:listLen]
+		}
+
+		for len(list) >= 3 {
+			nameType, nameLen := list[0], int(list[1])<<8|int(list[2])
+			list = list[3:]
+			if len(list) < nameLen {
+				break
+			}
+			if nameType == 0 { // host_name
+				return string(list[:nameLen]), total, true
+			}
+			list = list[nameLen:]
+		}
+	}
+
+	return "", total, false
+}
+
+// MatchSNI returns a Matcher that recognises a TLS ClientHello requesting
+// serverName via SNI, letting HTTPS vhosts be routed to distinct listeners
+// before the TLS handshake itself is performed.
+func MatchSNI(serverName string) Matcher {
+	return func(peek []byte) (string, int, bool) {
+		name, need, ok := sniFromClientHello(peek)
+		if !ok {
+			return "", need, false
+		}
+
+		return serverName, need, name == serverName
+	}
+}
@@ -1,64 +1,136 @@
 package mux
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
-	"log"
 	"net"
 	"sort"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
 type MultiplexerConfig struct {
 	SSH  bool
 	HTTP bool
+
+	// ProxyProtocol controls whether connections are expected to carry a
+	// HAProxy PROXY protocol header ahead of protocol detection.
+	ProxyProtocol ProxyProtocolMode
+
+	// TLS, when set, makes the multiplexer terminate TLS connections
+	// itself and re-dispatch based on the negotiated ALPN protocol. See
+	// HandleALPN.
+	TLS *tls.Config
+
+	// WebSocketSSHPath, when set, makes the multiplexer hijack HTTP
+	// requests upgrading to WebSocket at this path and feed the resulting
+	// framed connection into the SSH listener. This lets reverse-SSH
+	// clients stuck behind HTTP-only proxies reach the server on 80/443.
+	WebSocketSSHPath string
 }
 
 type Multiplexer struct {
 	sync.RWMutex
-	protocols      map[string]*multiplexerListener
-	done           bool
-	listeners      map[string]net.Listener
-	newConnections chan net.Conn
+	addr            net.Addr
+	opts            MultiplexerOptions
+	proxyProtocol   ProxyProtocolMode
+	tlsConfig       *tls.Config
+	alpn            map[string]*multiplexerListener
+	wsSSHPath       string
+	protocols       map[string]*multiplexerListener
+	matchers        []matcherRegistration
+	defaultListener *multiplexerListener
+	done            bool
+	closed          chan struct{}
+	listeners       map[string]net.Listener
+	listenerStats   map[string]*listenerStats
+	subscribers     map[chan ListenerEvent]struct{}
+	newConnections  chan acceptedConn
+}
+
+// acceptedConn pairs a freshly accepted connection with the listener stats
+// for the address it came in on, so drops discovered later during protocol
+// detection can still be attributed to the right listener.
+type acceptedConn struct {
+	conn  net.Conn
+	stats *listenerStats
 }
 
 func (m *Multiplexer) StartListener(network, address string) error {
+	return m.StartListenerContext(context.Background(), network, address)
+}
+
+// StartListenerContext is like StartListener, but ctx being cancelled closes
+// the listener and lets its accept loop exit deterministically, rather than
+// relying solely on an explicit StopListener/Close call racing with it.
+func (m *Multiplexer) StartListenerContext(ctx context.Context, network, address string) error {
 	m.Lock()
-	defer m.Unlock()
 
 	if _, ok := m.listeners[address]; ok {
+		m.Unlock()
 		return errors.New("Address " + address + " already listening")
 	}
 
 	listener, err := net.Listen(network, address)
 	if err != nil {
+		m.Unlock()
 		return err
 	}
 
+	stats := &listenerStats{startedAt: time.Now()}
+
 	m.listeners[address] = listener
+	m.listenerStats[address] = stats
+
+	m.Unlock()
+
+	m.emit(ListenerEvent{Type: ListenerAdded, Address: address})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-m.closed:
+		}
+	}()
 
 	go func(listen net.Listener) {
 		for {
 			conn, err := listen.Accept()
 			if err != nil {
-				if strings.Contains(err.Error(), "use of closed network connection") {
-					m.Lock()
+				// listenerStats is deliberately left in place here: a
+				// Subscribe consumer reacting to the event below by calling
+				// ListenerStats(address) needs to still find the entry,
+				// with LastError/StartedAt intact, even though the
+				// listener itself is already gone from m.listeners.
+				m.Lock()
+				delete(m.listeners, address)
+				m.Unlock()
 
-					delete(m.listeners, address)
-
-					m.Unlock()
-					return
+				if strings.Contains(err.Error(), "use of closed network connection") {
+					m.emit(ListenerEvent{Type: ListenerRemoved, Address: address})
+				} else {
+					stats.recordError(err)
+					m.emit(ListenerEvent{Type: ListenerErrored, Address: address, Err: err})
 				}
-				continue
+				return
+			}
+
+			stats.recordAccept()
 
+			if m.opts.OnAccept != nil {
+				m.opts.OnAccept(conn)
 			}
 
-			go func() {
-				m.newConnections <- conn
-			}()
+			// Sending directly into the buffered channel, rather than
+			// spawning a goroutine per connection just to enqueue it,
+			// means that once MaxPendingConnections connections are
+			// awaiting detection this call blocks - applying real
+			// backpressure to the accept loop (and so to the OS accept
+			// queue) instead of silently dropping connections.
+			m.newConnections <- acceptedConn{conn: conn, stats: stats}
 		}
 
 	}(listener)
@@ -92,64 +164,174 @@ func (m *Multiplexer) GetListeners() []string {
 	return listeners
 }
 
-func ListenWithConfig(network, address string, c MultiplexerConfig) (*Multiplexer, error) {
+// HandleFunc registers matcher under name and returns the net.Listener
+// named name. A recognised connection goes to the listener registered under
+// the name the matcher itself returns, so that name must equal name for this
+// listener to receive it (MatchSNI returns its serverName). Matchers are tried in
+// registration order, so register more specific matchers (e.g. MatchSNI for
+// a particular vhost) ahead of general ones.
+func (m *Multiplexer) HandleFunc(name string, matcher Matcher) net.Listener {
+	m.Lock()
+	defer m.Unlock()
+
+	l, ok := m.protocols[name]
+	if !ok {
+		l = newMultiplexerListener(name, m.addr)
+		m.protocols[name] = l
+	}
+
+	m.matchers = append(m.matchers, matcherRegistration{name: name, matcher: matcher})
+
+	return l
+}
+
+// HandleDefault registers a catch-all listener that receives any connection
+// no registered Matcher recognised, the same way cmux falls back to a
+// default listener. Calling it more than once returns the same listener.
+func (m *Multiplexer) HandleDefault() net.Listener {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.defaultListener == nil {
+		m.defaultListener = newMultiplexerListener("default", m.addr)
+	}
+
+	return m.defaultListener
+}
+
+// dispatchWorkers is the size of the worker pool draining newConnections.
+// It's deliberately fixed rather than derived from MaxPendingConnections:
+// the pool only needs enough concurrency to keep up with detection work,
+// while MaxPendingConnections bounds how many connections may queue up
+// behind it.
+const dispatchWorkers = 32
+
+func ListenWithConfig(network, address string, c MultiplexerConfig, opts MultiplexerOptions) (*Multiplexer, error) {
 
 	var m Multiplexer
 
-	m.newConnections = make(chan net.Conn)
+	m.opts = opts.withDefaults()
+	m.closed = make(chan struct{})
+	m.newConnections = make(chan acceptedConn, m.opts.MaxPendingConnections)
 	m.listeners = make(map[string]net.Listener)
+	m.listenerStats = make(map[string]*listenerStats)
+	m.subscribers = make(map[chan ListenerEvent]struct{})
 	m.protocols = map[string]*multiplexerListener{}
+	m.alpn = map[string]*multiplexerListener{}
 
 	err := m.StartListener(network, address)
 	if err != nil {
 		return nil, err
 	}
 
+	m.addr = m.listeners[address].Addr()
+	m.proxyProtocol = c.ProxyProtocol
+	m.tlsConfig = c.TLS
+	m.wsSSHPath = c.WebSocketSSHPath
+
 	if c.SSH {
-		m.protocols["ssh"] = newMultiplexerListener(m.listeners[address].Addr())
+		m.HandleFunc("ssh", MatchSSH)
 	}
 
 	if c.HTTP {
-		m.protocols["http"] = newMultiplexerListener(m.listeners[address].Addr())
+		m.HandleFunc("http", MatchHTTP1)
 	}
 
-	var waitingConnections int32
-	go func() {
-		for conn := range m.newConnections {
+	if c.TLS != nil {
+		m.HandleFunc(tlsProtocolName, MatchTLS)
 
-			if atomic.LoadInt32(&waitingConnections) > 1000 {
-				conn.Close()
-				continue
-			}
+		// SSH()/HTTP() transparently also receive TLS connections that
+		// negotiate the matching ALPN protocol, so callers don't need to
+		// juggle a separate listener for TLS-wrapped traffic.
+		if c.SSH {
+			m.alpn["ssh"] = m.protocols["ssh"]
+		}
+		if c.HTTP {
+			m.alpn["http/1.1"] = m.protocols["http"]
+		}
+	}
 
-			//Atomic as other threads may be writing and reading while we do this
-			atomic.AddInt32(&waitingConnections, 1)
-			go func(conn net.Conn) {
+	for i := 0; i < dispatchWorkers; i++ {
+		go m.dispatchLoop()
+	}
 
-				conn.SetDeadline(time.Now().Add(2 * time.Second))
-				l, prefix, err := m.determineProtocol(conn)
-				if err != nil {
-					conn.Close()
-					log.Println("Multiplexing failed: ", err)
-					return
-				}
+	return &m, nil
+}
+
+// dispatchLoop drains newConnections, running protocol detection on each
+// connection and handing it off to the matched listener. A fixed pool of
+// these replaces the old pattern of spawning one goroutine per connection.
+func (m *Multiplexer) dispatchLoop() {
+	for ac := range m.newConnections {
+		m.dispatch(ac.conn, ac.stats)
+	}
+}
 
-				conn.SetDeadline(time.Time{})
+func (m *Multiplexer) drop(conn net.Conn, stats *listenerStats, err error) {
+	conn.SetDeadline(time.Time{})
+	conn.Close()
 
-				select {
-				//Allow whatever we're multiplexing to apply backpressure if we cant accept things
-				case l.connections <- &bufferedConn{conn: conn, prefix: prefix}:
-				case <-time.After(2 * time.Second):
-					conn.Close()
-				}
+	if stats != nil {
+		stats.mu.Lock()
+		stats.droppedCount++
+		stats.mu.Unlock()
+	}
 
-				atomic.AddInt32(&waitingConnections, -1)
-			}(conn)
+	if m.opts.OnDrop != nil {
+		m.opts.OnDrop(conn, err)
+	}
+}
 
+func (m *Multiplexer) dispatch(conn net.Conn, stats *listenerStats) {
+	conn.SetDeadline(time.Now().Add(m.opts.HandshakeTimeout))
+
+	var proxy *proxyInfo
+	var seed []byte
+	if m.proxyProtocol != ProxyProtocolDisabled {
+		var err error
+		proxy, seed, err = acceptProxyProtocol(conn, m.proxyProtocol)
+		if err != nil {
+			m.drop(conn, stats, err)
+			m.opts.ErrorHandler(conn, err)
+			return
 		}
-	}()
+	}
 
-	return &m, nil
+	l, prefix, err := m.determineProtocol(conn, seed)
+	if err != nil {
+		m.drop(conn, stats, err)
+		m.opts.ErrorHandler(conn, err)
+		return
+	}
+
+	if l.name == tlsProtocolName {
+		// dispatchTLS clears the handshake deadline itself once the TLS
+		// handshake (which the deadline we just set also bounds) completes.
+		m.dispatchTLS(conn, prefix, proxy, stats)
+		return
+	}
+
+	if l.name == "http" && m.wsSSHPath != "" {
+		handled, wsPrefix := m.maybeDispatchWebSocketSSH(conn, prefix, proxy, stats)
+		if handled {
+			conn.SetDeadline(time.Time{})
+			return
+		}
+		prefix = wsPrefix
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	if m.opts.OnDetect != nil {
+		m.opts.OnDetect(conn, l.name)
+	}
+
+	select {
+	//Allow whatever we're multiplexing to apply backpressure if we cant accept things
+	case l.connections <- &bufferedConn{conn: conn, prefix: prefix, proxy: proxy}:
+	case <-time.After(m.opts.DispatchTimeout):
+		m.drop(conn, stats, errors.New("Dispatch to "+l.name+" listener timed out"))
+	}
 }
 
 func Listen(network, address string) (*Multiplexer, error) {
@@ -158,13 +340,26 @@ func Listen(network, address string) (*Multiplexer, error) {
 		HTTP: true,
 	}
 
-	return ListenWithConfig(network, address, c)
+	return ListenWithConfig(network, address, c, DefaultMultiplexerOptions())
 }
 
 func (m *Multiplexer) Close() {
 	m.done = true
 
+	close(m.closed)
+
+	// Snapshot the addresses under RLock before iterating: StopListener
+	// closing a listener causes its accept loop to delete itself from
+	// m.listeners concurrently, which would otherwise race with ranging
+	// over the live map here.
+	m.RLock()
+	addresses := make([]string, 0, len(m.listeners))
 	for address := range m.listeners {
+		addresses = append(addresses, address)
+	}
+	m.RUnlock()
+
+	for _, address := range addresses {
 		m.StopListener(address)
 	}
 
@@ -172,50 +367,81 @@ func (m *Multiplexer) Close() {
 		v.Close()
 	}
 
+	if m.defaultListener != nil {
+		m.defaultListener.Close()
+	}
+
 	close(m.newConnections)
 
 }
 
-func isHttp(b []byte) bool {
-
-	validMethods := [][]byte{
-		[]byte("GET"), []byte("HEAD"), []byte("POST"),
-		[]byte("PUT"), []byte("DELETE"), []byte("CONNECT"),
-		[]byte("OPTIONS"), []byte("TRACE"), []byte("PATCH"),
-	}
+// initialPeekSize is the default ReadPeekSize: the initial capacity of the
+// peek buffer, before matchers ask for more data. maxPeekSize bounds how far
+// we'll grow the peek buffer looking for a match (a full TLS ClientHello
+// can be a few KB) before giving up.
+const (
+	initialPeekSize = 3
+	maxPeekSize     = 8 << 10
+)
 
-	for _, vm := range validMethods {
-		if bytes.HasPrefix(b, vm) {
-			return true
+// determineProtocol reads just enough from c to let a registered Matcher
+// recognise its protocol, growing the peek buffer on demand when a matcher
+// reports it needs more data than we've read so far. seed is prepended to
+// the peek buffer, for bytes already consumed off the wire upstream (e.g.
+// while checking for a PROXY protocol header) that need to be considered
+// part of the connection's data. The bytes consumed are returned so the
+// caller can replay them via bufferedConn.
+func (m *Multiplexer) determineProtocol(c net.Conn, seed []byte) (*multiplexerListener, []byte, error) {
+	peek := make([]byte, len(seed), len(seed)+m.opts.ReadPeekSize)
+	copy(peek, seed)
+
+	for {
+		m.RLock()
+		matchers := m.matchers
+		protocols := m.protocols
+		defaultListener := m.defaultListener
+		m.RUnlock()
+
+		need := len(peek)
+		for _, reg := range matchers {
+			name, n, ok := reg.matcher(peek)
+			if ok {
+				if l, known := protocols[name]; known {
+					return l, peek, nil
+				}
+				continue
+			}
+			if n > need {
+				need = n
+			}
 		}
-	}
 
-	return false
-}
-
-func (m *Multiplexer) determineProtocol(c net.Conn) (*multiplexerListener, []byte, error) {
-	b := make([]byte, 3)
-	_, err := c.Read(b)
-	if err != nil {
-		return nil, nil, err
-	}
+		if need <= len(peek) || len(peek) >= maxPeekSize {
+			if defaultListener != nil {
+				return defaultListener, peek, nil
+			}
+			return nil, nil, errors.New("Unknown protocol")
+		}
 
-	proto := ""
-	if bytes.HasPrefix(b, []byte{'S', 'S', 'H'}) {
-		proto = "ssh"
-	} else if isHttp(b) {
-		proto = "http"
-	}
+		if need > maxPeekSize {
+			need = maxPeekSize
+		}
 
-	l, ok := m.protocols[proto]
-	if !ok {
-		return nil, nil, errors.New("Unknown protocol")
+		grow := make([]byte, need-len(peek))
+		n, err := c.Read(grow)
+		if n > 0 {
+			peek = append(peek, grow[:n]...)
+		}
+		if err != nil && n == 0 {
+			return nil, nil, err
+		}
 	}
-
-	return l, b, nil
 }
 
 func (m *Multiplexer) getProtoListener(proto string) net.Listener {
+	m.RLock()
+	defer m.RUnlock()
+
 	ml, ok := m.protocols[proto]
 	if !ok {
 		panic("Unknown protocol passed: " + proto)
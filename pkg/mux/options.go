@@ -0,0 +1,85 @@
+package mux
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// MultiplexerOptions tunes the multiplexer's buffering, timeouts and
+// observability hooks. Any field left at its zero value falls back to the
+// corresponding value in DefaultMultiplexerOptions.
+type MultiplexerOptions struct {
+	// MaxPendingConnections caps how many accepted connections may be
+	// waiting for protocol detection at once. It sizes the buffer between
+	// the accept loops and the dispatch workers, so a slow matcher can't
+	// grow memory usage unboundedly; once full, the accept loop itself
+	// blocks, applying backpressure to the underlying net.Listener.
+	MaxPendingConnections int
+
+	// HandshakeTimeout bounds how long protocol detection may take on a
+	// single connection before it's abandoned.
+	HandshakeTimeout time.Duration
+
+	// DispatchTimeout bounds how long we'll wait for a detected
+	// connection's listener to Accept it before dropping the connection.
+	DispatchTimeout time.Duration
+
+	// ReadPeekSize is the initial capacity of the peek buffer used during
+	// protocol detection. It does not set how many bytes are read: each
+	// read is sized by the largest amount a registered Matcher reports it
+	// still needs.
+	ReadPeekSize int
+
+	// ErrorHandler is invoked whenever a connection fails protocol
+	// detection, in place of the previous hard-coded log line.
+	ErrorHandler func(net.Conn, error)
+
+	// OnAccept is invoked for every connection accepted from the network,
+	// before protocol detection runs.
+	OnAccept func(net.Conn)
+
+	// OnDetect is invoked once a connection's protocol has been
+	// determined, naming the matched protocol.
+	OnDetect func(net.Conn, string)
+
+	// OnDrop is invoked whenever a connection is dropped, whether due to a
+	// failed/timed-out detection or a dispatch timeout.
+	OnDrop func(net.Conn, error)
+}
+
+// DefaultMultiplexerOptions returns the options Listen uses.
+func DefaultMultiplexerOptions() MultiplexerOptions {
+	return MultiplexerOptions{
+		MaxPendingConnections: 1000,
+		HandshakeTimeout:      2 * time.Second,
+		DispatchTimeout:       2 * time.Second,
+		ReadPeekSize:          initialPeekSize,
+		ErrorHandler: func(conn net.Conn, err error) {
+			log.Println("Multiplexing failed: ", err)
+		},
+	}
+}
+
+// withDefaults fills any zero-valued field of o with the matching default.
+func (o MultiplexerOptions) withDefaults() MultiplexerOptions {
+	d := DefaultMultiplexerOptions()
+
+	if o.MaxPendingConnections <= 0 {
+		o.MaxPendingConnections = d.MaxPendingConnections
+	}
+	if o.HandshakeTimeout <= 0 {
+		o.HandshakeTimeout = d.HandshakeTimeout
+	}
+	if o.DispatchTimeout <= 0 {
+		o.DispatchTimeout = d.DispatchTimeout
+	}
+	if o.ReadPeekSize <= 0 {
+		o.ReadPeekSize = d.ReadPeekSize
+	}
+	if o.ErrorHandler == nil {
+		o.ErrorHandler = d.ErrorHandler
+	}
+
+	return o
+}
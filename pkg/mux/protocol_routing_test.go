@@ -0,0 +1,90 @@
+package mux
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProtocolRoutingThroughDispatch drives two real TCP connections through
+// a live Multiplexer - one sending an SSH identification string, one an
+// HTTP/1.1 request line - and checks each is handed to the listener its
+// Matcher recognised, via the real dispatch() path rather than calling a
+// matcher function directly.
+func TestProtocolRoutingThroughDispatch(t *testing.T) {
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{SSH: true, HTTP: true}, MultiplexerOptions{
+		DispatchTimeout:  time.Second,
+		HandshakeTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ListenWithConfig: %v", err)
+	}
+	defer m.Close()
+
+	addr := m.addr.String()
+
+	sshConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing ssh connection: %v", err)
+	}
+	defer sshConn.Close()
+	if _, err := sshConn.Write([]byte("SSH-2.0-OpenSSH_9.0\r\n")); err != nil {
+		t.Fatalf("writing ssh identification string: %v", err)
+	}
+
+	sshAccepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := m.SSH().Accept()
+		if err == nil {
+			sshAccepted <- c
+		}
+	}()
+
+	select {
+	case c := <-sshAccepted:
+		defer c.Close()
+		buf := make([]byte, 64)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("reading from routed ssh connection: %v", err)
+		}
+		if !strings.HasPrefix(string(buf[:n]), "SSH") {
+			t.Fatalf("ssh listener got unexpected payload: %q", buf[:n])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for connection on SSH() listener")
+	}
+
+	httpConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing http connection: %v", err)
+	}
+	defer httpConn.Close()
+	if _, err := httpConn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil {
+		t.Fatalf("writing http request: %v", err)
+	}
+
+	httpAccepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := m.HTTP().Accept()
+		if err == nil {
+			httpAccepted <- c
+		}
+	}()
+
+	select {
+	case c := <-httpAccepted:
+		defer c.Close()
+		buf := make([]byte, 64)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("reading from routed http connection: %v", err)
+		}
+		if !strings.HasPrefix(string(buf[:n]), "GET") {
+			t.Fatalf("http listener got unexpected payload: %q", buf[:n])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for connection on HTTP() listener")
+	}
+}
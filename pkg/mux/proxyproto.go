@@ -0,0 +1,216 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocolMode controls whether the multiplexer expects connections to
+// carry a HAProxy PROXY protocol header describing the real client before
+// protocol detection runs, as is the case when reverse-SSH sits behind an
+// L4 load balancer.
+type ProxyProtocolMode int
+
+const (
+	// ProxyProtocolDisabled never looks for a PROXY protocol header.
+	ProxyProtocolDisabled ProxyProtocolMode = iota
+	// ProxyProtocolOptional parses a PROXY protocol header when present,
+	// but also accepts connections that don't send one.
+	ProxyProtocolOptional
+	// ProxyProtocolRequired rejects any connection that doesn't start
+	// with a valid PROXY protocol header.
+	ProxyProtocolRequired
+)
+
+// maxProxyProtocolV1Line is the longest a PROXY protocol v1 header line is
+// allowed to be per the spec (including the trailing "\r\n").
+const maxProxyProtocolV1Line = 107
+
+var proxyProtocolV1Prefix = []byte("PROXY ")
+var proxyProtocolV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+// proxyInfo carries the real client/destination addresses described by a
+// PROXY protocol header.
+type proxyInfo struct {
+	source      net.Addr
+	destination net.Addr
+}
+
+// proxyAddr is a minimal net.Addr for addresses parsed out of a PROXY
+// protocol header, since all we have is a network name and a host:port.
+type proxyAddr struct {
+	network string
+	address string
+}
+
+func (a proxyAddr) Network() string { return a.network }
+func (a proxyAddr) String() string  { return a.address }
+
+// acceptProxyProtocol consumes a PROXY protocol v1 or v2 header from c, if
+// one is present, and returns the addresses it described. If c didn't start
+// with a header - including a v1-looking connection that turns out not to
+// be one, such as a plain HTTP "POST"/"PUT"/"PATCH" request, which also
+// starts with 'P' - the bytes already read off the wire while checking are
+// returned as seed so they can be replayed to protocol detection. In
+// ProxyProtocolRequired mode a connection that doesn't send a valid header
+// is rejected instead.
+func acceptProxyProtocol(c net.Conn, mode ProxyProtocolMode) (info *proxyInfo, seed []byte, err error) {
+	first := make([]byte, 1)
+	n, err := c.Read(first)
+	if n == 0 {
+		return nil, nil, err
+	}
+
+	switch first[0] {
+	case proxyProtocolV1Prefix[0]:
+		info, consumed, err := readProxyProtocolV1(c, first[0])
+		if err != nil {
+			if mode == ProxyProtocolRequired {
+				return nil, nil, err
+			}
+			return nil, consumed, nil
+		}
+		return info, nil, nil
+
+	case proxyProtocolV2Signature[0]:
+		rest := make([]byte, len(proxyProtocolV2Signature)-1)
+		rn, rerr := io.ReadFull(c, rest)
+		peeked := append(append([]byte{}, first...), rest[:rn]...)
+
+		if rerr != nil || !bytes.Equal(peeked, proxyProtocolV2Signature) {
+			if mode == ProxyProtocolRequired {
+				return nil, nil, errors.New("PROXY protocol required but connection did not send a valid header")
+			}
+			return nil, peeked, nil
+		}
+
+		info, err := readProxyProtocolV2(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		return info, nil, nil
+	}
+
+	if mode == ProxyProtocolRequired {
+		return nil, nil, errors.New("PROXY protocol required but connection did not send one")
+	}
+
+	return nil, first, nil
+}
+
+// readProxyProtocolV1 reads the rest of an ASCII PROXY protocol v1 header
+// line (e.g. "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"), given
+// that firstByte has already been read off c. If the bytes read don't
+// actually form a valid header - e.g. an ordinary "POST ..." HTTP request,
+// which also happens to start with 'P' - it returns the bytes consumed so
+// far as consumed, so the caller can fall back to treating them as seed
+// for protocol detection instead of failing the connection outright.
+func readProxyProtocolV1(c net.Conn, firstByte byte) (info *proxyInfo, consumed []byte, err error) {
+	line := []byte{firstByte}
+	b := make([]byte, 1)
+
+	for len(line) < maxProxyProtocolV1Line {
+		n, rerr := c.Read(b)
+		if n == 0 {
+			return nil, line, rerr
+		}
+
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasPrefix(line, proxyProtocolV1Prefix) {
+		return nil, line, errors.New("Malformed PROXY protocol v1 header")
+	}
+
+	fields := strings.Fields(strings.TrimSpace(string(line)))
+	if len(fields) < 2 {
+		return nil, line, errors.New("Malformed PROXY protocol v1 header")
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return &proxyInfo{}, nil, nil
+	}
+
+	if len(fields) != 6 {
+		return nil, line, errors.New("Malformed PROXY protocol v1 header")
+	}
+
+	network := strings.ToLower(fields[1])
+
+	return &proxyInfo{
+		source:      proxyAddr{network: network, address: net.JoinHostPort(fields[2], fields[4])},
+		destination: proxyAddr{network: network, address: net.JoinHostPort(fields[3], fields[5])},
+	}, nil, nil
+}
+
+// readProxyProtocolV2 reads a binary PROXY protocol v2 header, given that
+// the 12-byte signature has already been consumed from c.
+func readProxyProtocolV2(c net.Conn) (*proxyInfo, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return nil, err
+	}
+
+	version := header[0] >> 4
+	if version != 2 {
+		return nil, errors.New("Unsupported PROXY protocol v2 version")
+	}
+	command := header[0] & 0x0f
+
+	addressFamily := header[1] >> 4
+	transport := header[1] & 0x0f
+
+	length := binary.BigEndian.Uint16(header[2:4])
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, err
+	}
+
+	if command == 0x0 {
+		// LOCAL: a health check from the proxy itself, no real client.
+		return &proxyInfo{}, nil
+	}
+
+	network := "tcp"
+	if transport == 0x2 {
+		network = "udp"
+	}
+
+	switch addressFamily {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("Malformed PROXY protocol v2 IPv4 address block")
+		}
+
+		return &proxyInfo{
+			source:      proxyAddr{network: network, address: joinIPPort(body[0:4], body[8:10])},
+			destination: proxyAddr{network: network, address: joinIPPort(body[4:8], body[10:12])},
+		}, nil
+
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("Malformed PROXY protocol v2 IPv6 address block")
+		}
+
+		return &proxyInfo{
+			source:      proxyAddr{network: network, address: joinIPPort(body[0:16], body[32:34])},
+			destination: proxyAddr{network: network, address: joinIPPort(body[16:32], body[34:36])},
+		}, nil
+
+	default: // AF_UNSPEC, AF_UNIX, ... - nothing routable to report
+		return &proxyInfo{}, nil
+	}
+}
+
+func joinIPPort(ip, port []byte) string {
+	p := binary.BigEndian.Uint16(port)
+	return net.JoinHostPort(net.IP(ip).String(), strconv.Itoa(int(p)))
+}
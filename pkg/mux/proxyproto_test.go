@@ -0,0 +1,140 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn backed by an in-memory buffer, just enough
+// to drive the PROXY protocol parsers without touching the network.
+type fakeConn struct {
+	r io.Reader
+}
+
+func (f *fakeConn) Read(p []byte) (int, error)         { return f.r.Read(p) }
+func (f *fakeConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (f *fakeConn) Close() error                       { return nil }
+func (f *fakeConn) LocalAddr() net.Addr                { return nil }
+func (f *fakeConn) RemoteAddr() net.Addr               { return nil }
+func (f *fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (f *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (f *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestAcceptProxyProtocolV1(t *testing.T) {
+	conn := &fakeConn{r: bytes.NewReader([]byte("PROXY TCP4 10.0.0.1 10.0.0.2 56324 443\r\nrest-of-the-stream"))}
+
+	info, seed, err := acceptProxyProtocol(conn, ProxyProtocolOptional)
+	if err != nil {
+		t.Fatalf("acceptProxyProtocol: %v", err)
+	}
+	if len(seed) != 0 {
+		t.Fatalf("expected no seed bytes for a valid header, got %q", seed)
+	}
+	if info == nil || info.source.String() != "10.0.0.1:56324" {
+		t.Fatalf("unexpected source address: %+v", info)
+	}
+
+	rest, err := io.ReadAll(conn.r)
+	if err != nil {
+		t.Fatalf("reading remainder: %v", err)
+	}
+	if string(rest) != "rest-of-the-stream" {
+		t.Fatalf("header line consumed too much or too little, remainder = %q", rest)
+	}
+}
+
+func TestAcceptProxyProtocolV2(t *testing.T) {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x21, 0x11, 0x00, 0x0c) // v2 PROXY, AF_INET/TCP, 12-byte body
+	header = append(header, 10, 0, 0, 1)            // source IP
+	header = append(header, 10, 0, 0, 2)            // destination IP
+	header = append(header, 0xdc, 0x04)             // source port 56324
+	header = append(header, 0x01, 0xbb)             // destination port 443
+	header = append(header, "rest-of-the-stream"...)
+
+	conn := &fakeConn{r: bytes.NewReader(header)}
+
+	info, seed, err := acceptProxyProtocol(conn, ProxyProtocolOptional)
+	if err != nil {
+		t.Fatalf("acceptProxyProtocol: %v", err)
+	}
+	if len(seed) != 0 {
+		t.Fatalf("expected no seed bytes for a valid header, got %q", seed)
+	}
+	if info == nil || info.source.String() != "10.0.0.1:56324" {
+		t.Fatalf("unexpected source address: %+v", info)
+	}
+
+	rest, err := io.ReadAll(conn.r)
+	if err != nil {
+		t.Fatalf("reading remainder: %v", err)
+	}
+	if string(rest) != "rest-of-the-stream" {
+		t.Fatalf("header consumed too much or too little, remainder = %q", rest)
+	}
+}
+
+// TestAcceptProxyProtocolOptionalFallsBackForOrdinaryTraffic guards against a
+// regression where an ordinary HTTP request starting with 'P' (POST, PUT,
+// PATCH) was misdetected as a malformed PROXY protocol v1 header and the
+// connection was dropped, even though ProxyProtocolOptional promises to
+// also accept connections that don't send a PROXY header at all.
+func TestAcceptProxyProtocolOptionalFallsBackForOrdinaryTraffic(t *testing.T) {
+	requests := []string{
+		"POST /upload HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"PUT /object HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"PATCH /object HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	}
+
+	for _, req := range requests {
+		conn := &fakeConn{r: bytes.NewReader([]byte(req))}
+
+		info, seed, err := acceptProxyProtocol(conn, ProxyProtocolOptional)
+		if err != nil {
+			t.Fatalf("acceptProxyProtocol(%q): unexpected error: %v", req, err)
+		}
+		if info != nil {
+			t.Fatalf("acceptProxyProtocol(%q): expected no proxyInfo, got %+v", req, info)
+		}
+
+		rest, rerr := io.ReadAll(conn.r)
+		if rerr != nil {
+			t.Fatalf("reading remainder: %v", rerr)
+		}
+
+		if got := string(seed) + string(rest); got != req {
+			t.Fatalf("acceptProxyProtocol(%q): seed+remainder = %q, want original bytes preserved", req, got)
+		}
+	}
+}
+
+// TestAcceptProxyProtocolRequiredRejectsOrdinaryTraffic checks the other
+// half of the contract: in ProxyProtocolRequired mode, a connection that
+// doesn't send a valid header - including one that merely starts with 'P' -
+// is rejected rather than falling back.
+func TestAcceptProxyProtocolRequiredRejectsOrdinaryTraffic(t *testing.T) {
+	conn := &fakeConn{r: bytes.NewReader([]byte("POST /upload HTTP/1.1\r\nHost: example.com\r\n\r\n"))}
+
+	_, _, err := acceptProxyProtocol(conn, ProxyProtocolRequired)
+	if err == nil {
+		t.Fatal("expected an error in ProxyProtocolRequired mode, got nil")
+	}
+}
+
+func TestAcceptProxyProtocolUnknown(t *testing.T) {
+	conn := &fakeConn{r: bytes.NewReader([]byte("PROXY UNKNOWN\r\nrest-of-the-stream"))}
+
+	info, seed, err := acceptProxyProtocol(conn, ProxyProtocolOptional)
+	if err != nil {
+		t.Fatalf("acceptProxyProtocol: %v", err)
+	}
+	if len(seed) != 0 {
+		t.Fatalf("expected no seed bytes for a valid header, got %q", seed)
+	}
+	if info == nil || info.source != nil {
+		t.Fatalf("expected an empty proxyInfo for UNKNOWN, got %+v", info)
+	}
+}
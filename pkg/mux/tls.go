@@ -0,0 +1,77 @@
+package mux
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// tlsProtocolName is the reserved protocol name MatchTLS results are
+// registered under. Unlike other protocols it isn't handed to a plain
+// net.Listener - the multiplexer terminates TLS itself and re-dispatches
+// based on the negotiated ALPN protocol.
+const tlsProtocolName = "tls"
+
+// HandleALPN registers proto (an ALPN protocol name such as "h2" or a
+// user-defined value) and returns the net.Listener that will receive every
+// TLS connection negotiating it. It has no effect unless MultiplexerConfig.TLS
+// was set, since that's what lets the multiplexer terminate TLS in the
+// first place.
+func (m *Multiplexer) HandleALPN(proto string) net.Listener {
+	m.Lock()
+	defer m.Unlock()
+
+	l, ok := m.alpn[proto]
+	if !ok {
+		l = newMultiplexerListener("tls:"+proto, m.addr)
+		m.alpn[proto] = l
+	}
+
+	return l
+}
+
+// dispatchTLS terminates a connection that MatchTLS identified as a TLS
+// ClientHello, then re-dispatches the plaintext connection that comes out
+// the other side based on the ALPN protocol the client and server agreed
+// on, handing it to whatever listener was registered for that protocol via
+// HandleALPN (ListenWithConfig registers the SSH() and HTTP() listeners for
+// "ssh" and "http/1.1" when MultiplexerConfig.SSH/HTTP are enabled alongside
+// TLS). stats is the
+// listenerStats for the address the connection arrived on, so handshake
+// failures and drops here are still reflected in its DroppedCount, the same
+// as drops discovered in dispatch itself.
+func (m *Multiplexer) dispatchTLS(conn net.Conn, prefix []byte, proxy *proxyInfo, stats *listenerStats) {
+	plain := &bufferedConn{conn: conn, prefix: prefix, proxy: proxy}
+	tlsConn := tls.Server(plain, m.tlsConfig)
+
+	if err := tlsConn.Handshake(); err != nil {
+		m.drop(tlsConn, stats, err)
+		m.opts.ErrorHandler(conn, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	proto := tlsConn.ConnectionState().NegotiatedProtocol
+
+	m.RLock()
+	l, ok := m.alpn[proto]
+	m.RUnlock()
+
+	if !ok {
+		err := errors.New("No listener registered for ALPN protocol " + proto)
+		m.drop(tlsConn, stats, err)
+		m.opts.ErrorHandler(conn, err)
+		return
+	}
+
+	if m.opts.OnDetect != nil {
+		m.opts.OnDetect(conn, l.name)
+	}
+
+	select {
+	case l.connections <- &bufferedConn{conn: tlsConn, proxy: proxy}:
+	case <-time.After(m.opts.DispatchTimeout):
+		m.drop(tlsConn, stats, errors.New("Dispatch to "+l.name+" listener timed out"))
+	}
+}
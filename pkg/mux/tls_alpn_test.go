@@ -0,0 +1,104 @@
+package mux
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// generateSelfSignedCert produces an in-memory, self-signed certificate for
+// "localhost" valid for an hour, purely for exercising tls.Server/tls.Dial
+// in tests - never written to disk or reused across tests.
+func generateSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating test key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("creating test certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
+
+// TestTLSTerminationRoutesByALPN drives a real TLS handshake through
+// dispatch()/dispatchTLS and checks the plaintext connection that comes out
+// the other side is routed to the listener registered for the negotiated
+// ALPN protocol via HandleALPN.
+func TestTLSTerminationRoutesByALPN(t *testing.T) {
+	cert := generateSelfSignedCert(t)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"echo"},
+	}
+
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{TLS: serverConfig}, MultiplexerOptions{
+		DispatchTimeout:  time.Second,
+		HandshakeTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ListenWithConfig: %v", err)
+	}
+	defer m.Close()
+
+	echoListener := m.HandleALPN("echo")
+	go func() {
+		conn, err := echoListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		conn.Write(buf[:n])
+	}()
+
+	clientConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"echo"}}
+	conn, err := tls.Dial("tcp", m.addr.String(), clientConfig)
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("writing to tls connection: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("reading echo reply: %v", err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Fatalf("echo reply = %q, want %q", got, "hello")
+	}
+
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "echo" {
+		t.Fatalf("NegotiatedProtocol = %q, want %q", proto, "echo")
+	}
+}
@@ -0,0 +1,325 @@
+package mux
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// websocketMagic is the GUID RFC 6455 has every WebSocket server append to
+// the client's Sec-WebSocket-Key before hashing it to produce the accept
+// token.
+const websocketMagic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketUpgradeHead bounds how many bytes of request line and headers
+// we'll read while looking for a WebSocket upgrade before giving up.
+const maxWebSocketUpgradeHead = 8 << 10
+
+// maxWebSocketFrameLength bounds how large a single WebSocket frame's
+// payload is allowed to claim to be. Without this, the 64-bit length field
+// available via the 127-length-indicator encoding lets any client that
+// completes the handshake force an arbitrarily large allocation before a
+// single payload byte has been read off the wire.
+const maxWebSocketFrameLength = 32 << 20
+
+// maybeDispatchWebSocketSSH inspects an HTTP request that has already
+// matched the "http" protocol to see whether it's a WebSocket upgrade to
+// MultiplexerConfig.WebSocketSSHPath. If it is, it completes the WebSocket
+// handshake and feeds the resulting framed connection into the SSH
+// listener, returning true. Otherwise it returns false and raw, the bytes
+// consumed while checking, so the caller can replay them as the http
+// listener's prefix instead. stats is the listenerStats for the address the
+// connection arrived on, so a dispatch timeout here is still reflected in
+// its DroppedCount.
+func (m *Multiplexer) maybeDispatchWebSocketSSH(conn net.Conn, prefix []byte, proxy *proxyInfo, stats *listenerStats) (handled bool, raw []byte) {
+	method, path, headers, raw, err := readRequestHead(conn, prefix)
+	if err != nil {
+		return false, raw
+	}
+
+	if method != "GET" || path != m.wsSSHPath || !strings.EqualFold(headers["upgrade"], "websocket") {
+		return false, raw
+	}
+
+	key := headers["sec-websocket-key"]
+	if key == "" {
+		return false, raw
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAcceptKey(key) + "\r\n\r\n"
+
+	if _, err := conn.Write([]byte(response)); err != nil {
+		m.drop(conn, stats, err)
+		return true, nil
+	}
+
+	m.RLock()
+	l, ok := m.protocols["ssh"]
+	m.RUnlock()
+	if !ok {
+		m.drop(conn, stats, errors.New("No ssh listener registered for WebSocket-SSH upgrade"))
+		return true, nil
+	}
+
+	bc := &bufferedConn{conn: &websocketConn{conn: conn}, proxy: proxy}
+
+	select {
+	case l.connections <- bc:
+	case <-time.After(m.opts.DispatchTimeout):
+		m.drop(conn, stats, errors.New("Dispatch to ssh listener timed out"))
+	}
+
+	return true, nil
+}
+
+// websocketAcceptKey computes the Sec-WebSocket-Accept value for a client's
+// Sec-WebSocket-Key, per RFC 6455 section 4.2.2.
+func websocketAcceptKey(clientKey string) string {
+	h := sha1.Sum([]byte(clientKey + websocketMagic))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// readRequestHead reads an HTTP/1.x request line and headers a byte at a
+// time, starting from already-consumed prefix bytes, stopping at the blank
+// line that terminates the header block. Reading a byte at a time (rather
+// than through a buffered reader) avoids pulling any of the request body,
+// or a pipelined second request, off the wire before we've decided whether
+// we're handling this connection ourselves.
+func readRequestHead(c net.Conn, prefix []byte) (method, path string, headers map[string]string, raw []byte, err error) {
+	raw = append([]byte{}, prefix...)
+	b := make([]byte, 1)
+
+	// lineStart tracks where the current logical line begins within raw.
+	// It starts at 0, not len(raw), because prefix already holds bytes
+	// belonging to the request line (the bytes determineProtocol read to
+	// recognise "http", starting with the method) that must still be part
+	// of it.
+	lineStart := 0
+
+	readLine := func() (string, error) {
+		for {
+			if len(raw)-lineStart >= 2 && raw[len(raw)-2] == '\r' && raw[len(raw)-1] == '\n' {
+				line := string(raw[lineStart : len(raw)-2])
+				lineStart = len(raw)
+				return line, nil
+			}
+			if len(raw) > maxWebSocketUpgradeHead {
+				return "", errors.New("HTTP request head too large")
+			}
+
+			n, rerr := c.Read(b)
+			if n == 0 {
+				return "", rerr
+			}
+			raw = append(raw, b[0])
+		}
+	}
+
+	requestLine, err := readLine()
+	if err != nil {
+		return "", "", nil, raw, err
+	}
+
+	parts := strings.SplitN(requestLine, " ", 3)
+	if len(parts) < 2 {
+		return "", "", nil, raw, errors.New("Malformed HTTP request line")
+	}
+	method, path = parts[0], parts[1]
+
+	headers = map[string]string{}
+	for {
+		line, err := readLine()
+		if err != nil {
+			return "", "", nil, raw, err
+		}
+		if line == "" {
+			break
+		}
+
+		idx := strings.IndexByte(line, ':')
+		if idx < 0 {
+			continue
+		}
+
+		headers[strings.ToLower(strings.TrimSpace(line[:idx]))] = strings.TrimSpace(line[idx+1:])
+	}
+
+	return method, path, headers, raw, nil
+}
+
+const (
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// websocketConn unwraps/wraps a WebSocket-framed net.Conn so it behaves
+// like a plain stream: each inbound binary frame is delivered through Read,
+// and each Write is emitted as a single binary frame. Ping/pong/close
+// control frames are handled without surfacing them to the caller.
+type websocketConn struct {
+	conn    net.Conn
+	pending []byte
+}
+
+func (w *websocketConn) Read(p []byte) (int, error) {
+	for len(w.pending) == 0 {
+		payload, opcode, err := w.readFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsOpClose:
+			w.writeFrame(wsOpClose, nil)
+			w.conn.Close()
+			return 0, io.EOF
+		case wsOpPing:
+			w.writeFrame(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		default:
+			w.pending = payload
+		}
+	}
+
+	n := copy(p, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
+}
+
+func (w *websocketConn) Write(p []byte) (int, error) {
+	if err := w.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// readFrame reads one WebSocket frame and returns its (unmasked) payload
+// and opcode. Fragmented messages (FIN=0 continuations) are reassembled
+// into a single payload.
+func (w *websocketConn) readFrame() ([]byte, byte, error) {
+	var message []byte
+	var messageOpcode byte
+
+	for {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(w.conn, head); err != nil {
+			return nil, 0, err
+		}
+
+		fin := head[0]&0x80 != 0
+		opcode := head[0] & 0x0f
+		masked := head[1]&0x80 != 0
+		length := uint64(head[1] & 0x7f)
+
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(w.conn, ext); err != nil {
+				return nil, 0, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(w.conn, ext); err != nil {
+				return nil, 0, err
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
+
+		if length > maxWebSocketFrameLength {
+			return nil, 0, errors.New("WebSocket frame length exceeds maximum")
+		}
+
+		var maskKey [4]byte
+		if masked {
+			if _, err := io.ReadFull(w.conn, maskKey[:]); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(w.conn, payload); err != nil {
+			return nil, 0, err
+		}
+
+		if masked {
+			for i := range payload {
+				payload[i] ^= maskKey[i%4]
+			}
+		}
+
+		if opcode >= wsOpClose {
+			// Control frames are never fragmented, but may arrive between
+			// the fragments of a data message: answer pings and skip pongs
+			// here so the partial message isn't lost.
+			if len(message) == 0 || opcode == wsOpClose {
+				return payload, opcode, nil
+			}
+			if opcode == wsOpPing {
+				w.writeFrame(wsOpPong, payload)
+			}
+			continue
+		}
+
+		if opcode != wsOpContinuation {
+			messageOpcode = opcode
+		}
+		message = append(message, payload...)
+
+		if fin {
+			return message, messageOpcode, nil
+		}
+	}
+}
+
+// writeFrame emits payload as a single, unmasked, final frame with the
+// given opcode. Per RFC 6455 section 5.1, only client-to-server frames are
+// masked, so server-to-client frames (what we send here) are not.
+func (w *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+
+	switch {
+	case len(payload) <= 125:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(len(payload)))
+		header = append(header, 126)
+		header = append(header, ext...)
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(len(payload)))
+		header = append(header, 127)
+		header = append(header, ext...)
+	}
+
+	if _, err := w.conn.Write(header); err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	_, err := w.conn.Write(payload)
+	return err
+}
+
+func (w *websocketConn) Close() error                       { return w.conn.Close() }
+func (w *websocketConn) LocalAddr() net.Addr                { return w.conn.LocalAddr() }
+func (w *websocketConn) RemoteAddr() net.Addr               { return w.conn.RemoteAddr() }
+func (w *websocketConn) SetDeadline(t time.Time) error      { return w.conn.SetDeadline(t) }
+func (w *websocketConn) SetReadDeadline(t time.Time) error  { return w.conn.SetReadDeadline(t) }
+func (w *websocketConn) SetWriteDeadline(t time.Time) error { return w.conn.SetWriteDeadline(t) }
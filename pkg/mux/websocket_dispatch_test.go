@@ -0,0 +1,123 @@
+package mux
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readUntilBlankLine reads from c byte by byte until it has seen the
+// "\r\n\r\n" that terminates an HTTP response's headers, without pulling
+// any further bytes off the wire - mirroring readRequestHead's own
+// byte-at-a-time approach, since anything buffered ahead here would be
+// indistinguishable from the first WebSocket frame that follows.
+func readUntilBlankLine(t *testing.T, c net.Conn) string {
+	t.Helper()
+
+	buf := make([]byte, 0, 256)
+	b := make([]byte, 1)
+	for {
+		n, err := c.Read(b)
+		if n == 0 {
+			t.Fatalf("reading response head: %v", err)
+		}
+		buf = append(buf, b[0])
+		if len(buf) >= 4 && string(buf[len(buf)-4:]) == "\r\n\r\n" {
+			return string(buf)
+		}
+	}
+}
+
+// TestWebSocketSSHUpgradeThroughDispatch drives a real WebSocket-SSH
+// upgrade request through dispatch()/determineProtocol()/
+// maybeDispatchWebSocketSSH with a non-empty prefix (the bytes, starting
+// with "GET", that determineProtocol already read to recognise the
+// connection as HTTP), the
+// exact scenario that masked the request-line truncation bug readRequestHead
+// had: a test using a bare pipe with no prefix wouldn't have caught it.
+func TestWebSocketSSHUpgradeThroughDispatch(t *testing.T) {
+	m, err := ListenWithConfig("tcp", "127.0.0.1:0", MultiplexerConfig{
+		SSH:              true,
+		HTTP:             true,
+		WebSocketSSHPath: "/ssh",
+	}, MultiplexerOptions{
+		DispatchTimeout:  time.Second,
+		HandshakeTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ListenWithConfig: %v", err)
+	}
+	defer m.Close()
+
+	sshAccepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := m.SSH().Accept()
+		if err == nil {
+			sshAccepted <- c
+		}
+	}()
+
+	conn, err := net.Dial("tcp", m.addr.String())
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+
+	request := "GET /ssh HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("writing upgrade request: %v", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	response := readUntilBlankLine(t, conn)
+	if !strings.HasPrefix(response, "HTTP/1.1 101 Switching Protocols") {
+		t.Fatalf("upgrade request wasn't recognised as a WebSocket-SSH upgrade, got response: %q", response)
+	}
+	const wantAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" // RFC 6455 section 1.3 worked example
+	if !strings.Contains(response, "Sec-WebSocket-Accept: "+wantAccept) {
+		t.Fatalf("response missing expected Sec-WebSocket-Accept, got: %q", response)
+	}
+
+	var sshConn net.Conn
+	select {
+	case sshConn = <-sshAccepted:
+		defer sshConn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the WebSocket-SSH connection to reach SSH()'s listener")
+	}
+
+	client := &websocketConn{conn: conn}
+	if _, err := client.Write([]byte("PING-SSH")); err != nil {
+		t.Fatalf("writing client frame: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	sshConn.SetDeadline(time.Now().Add(2 * time.Second))
+	n, err := sshConn.Read(buf)
+	if err != nil {
+		t.Fatalf("reading from the routed ssh connection: %v", err)
+	}
+	if got := string(buf[:n]); got != "PING-SSH" {
+		t.Fatalf("ssh listener got %q, want %q", got, "PING-SSH")
+	}
+
+	if _, err := sshConn.Write([]byte("PONG-SSH")); err != nil {
+		t.Fatalf("writing reply: %v", err)
+	}
+
+	reply := make([]byte, 64)
+	n, err = client.Read(reply)
+	if err != nil {
+		t.Fatalf("reading client-side websocket frame: %v", err)
+	}
+	if got := string(reply[:n]); got != "PONG-SSH" {
+		t.Fatalf("client got %q, want %q", got, "PONG-SSH")
+	}
+}